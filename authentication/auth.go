@@ -2,8 +2,15 @@ package authentication
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,8 +21,39 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/scrypt"
 )
 
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeDeviceCode        = "device_code"
+	GrantTypeClientCredentials = "client_credentials"
+)
+
+const defaultDeviceCodePollInterval = 5 * time.Second
+
+// pkceVerifierTTL bounds how long a code verifier is kept around waiting for
+// its matching /callback request, so abandoned login attempts don't leak.
+const pkceVerifierTTL = 10 * time.Minute
+
+// credentialsEncryptionSalt is a fixed scrypt salt. It doesn't need to be
+// secret or per-installation: its only job is to stop a precomputed rainbow
+// table over common passphrases from applying across all deployments.
+var credentialsEncryptionSalt = []byte("outlook-events-portal-credentials")
+
+var errAuthorizationPending = errors.New("authorization_pending")
+var errSlowDown = errors.New("slow_down")
+
+type pkceEntry struct {
+	verifier string
+	created  time.Time
+}
+
+var pkceStore = struct {
+	sync.Mutex
+	entries map[string]pkceEntry
+}{entries: map[string]pkceEntry{}}
+
 type CredentialStorage struct {
 	lock             sync.Mutex
 	credentials      GraphAuthentication
@@ -38,12 +76,48 @@ type OauthConfig struct {
 	ServerProtocol string
 	ServerHost     string
 	ServerPort     int
+	// GrantType selects the OAuth flow used to authenticate: "authorization_code"
+	// (default, interactive browser flow), "device_code" (for headless machines)
+	// or "client_credentials" (app-only, no signed-in user).
+	GrantType string
+	// TLSCert and TLSKey, when both set, serve the callback listener over
+	// HTTPS with this certificate instead of plain HTTP. Required by Azure AD
+	// for any non-localhost redirect URI.
+	TLSCert string
+	TLSKey  string
+	// ACMECacheDir, when set, requests and renews a certificate automatically
+	// via ACME/Let's Encrypt instead of using TLSCert/TLSKey, caching it here.
+	ACMECacheDir string
 }
 
 type CredentialsConfig struct {
 	Browser     bool
 	Persist     bool
 	StoragePath string
+	// DeviceCodeFilePath, when set, receives the user code and verification URI
+	// for the device code flow so kiosk displays can render them.
+	DeviceCodeFilePath string
+	// EncryptionKey, when set, is used to encrypt credentials.toml at rest
+	// with AES-256-GCM. A 32-byte value is used as the key directly;
+	// anything else is treated as a passphrase and stretched via scrypt.
+	EncryptionKey string
+	// AllowPlaintextStorage must be set explicitly to persist credentials
+	// without EncryptionKey, to avoid silently writing tokens in the clear.
+	AllowPlaintextStorage bool
+}
+
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+	Message         string `json:"message"`
+}
+
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type Logger interface {
@@ -79,9 +153,26 @@ func loadExistingCredentials() {
 	if !credentialsConfig.Persist {
 		return
 	}
-	credentialsContent, err := os.ReadFile(filepath.Join(credentialsConfig.StoragePath, "credentials.toml"))
+	credentialsPath := filepath.Join(credentialsConfig.StoragePath, "credentials.toml")
+	credentialsContent, err := os.ReadFile(credentialsPath)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error loading existing credentials file: %s", err.Error()))
+		return
+	}
+
+	if len(credentialsConfig.EncryptionKey) > 0 {
+		decrypted, err := decryptCredentials(credentialsContent)
+		if err != nil {
+			// Fail closed: a file we can't decrypt is as good as missing, and
+			// keeping it around only invites retrying the same bad key forever.
+			logger.Error(fmt.Sprintf("Error decrypting existing credentials file, forcing re-login: %s", err.Error()))
+			os.Remove(credentialsPath)
+			return
+		}
+		credentialsContent = decrypted
+	} else if !credentialsConfig.AllowPlaintextStorage {
+		logger.Error("Refusing to load plaintext credentials file: set EncryptionKey or AllowPlaintextStorage=true")
+		return
 	}
 
 	_, err = toml.Decode(string(credentialsContent), &graphCredentialStorage.credentials)
@@ -90,6 +181,64 @@ func loadExistingCredentials() {
 	}
 }
 
+// deriveEncryptionKey turns EncryptionKey into a 32-byte AES-256 key: used
+// directly if it's already 32 bytes, otherwise stretched via scrypt.
+func deriveEncryptionKey(secret string) ([]byte, error) {
+	if len(secret) == 32 {
+		return []byte(secret), nil
+	}
+
+	return scrypt.Key([]byte(secret), credentialsEncryptionSalt, 1<<15, 8, 1, 32)
+}
+
+func encryptCredentials(plaintext []byte) ([]byte, error) {
+	key, err := deriveEncryptionKey(credentialsConfig.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptCredentials(ciphertext []byte) ([]byte, error) {
+	key, err := deriveEncryptionKey(credentialsConfig.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted credentials file is too short")
+	}
+
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
 func Run(oauth *OauthConfig, appConfig *CredentialsConfig, log Logger) *CredentialStorage {
 
 	oauthConfig = *oauth
@@ -111,8 +260,25 @@ func Run(oauth *OauthConfig, appConfig *CredentialsConfig, log Logger) *Credenti
 			return nil
 		}
 	}
-	// The browser can connect now because the listening socket is open.
-	openLoginPage()
+
+	switch oauthConfig.GrantType {
+	case GrantTypeDeviceCode:
+		// deviceCodeFlow polls for up to the device code's expiry (minutes),
+		// so run it in the background: Run must return immediately and let
+		// the caller start serving, same as the interactive browser flow.
+		go func() {
+			if err := deviceCodeFlow(); err == nil {
+				graphCredentialStorage.refreshTokenManager()
+			}
+		}()
+	case GrantTypeClientCredentials:
+		if err := clientCredentialsFlow(); err == nil {
+			go graphCredentialStorage.refreshTokenManager()
+		}
+	default:
+		// The browser can connect now because the listening socket is open.
+		openLoginPage()
+	}
 
 	return &graphCredentialStorage
 }
@@ -150,7 +316,12 @@ func (credentials *CredentialStorage) refreshTokenManager() {
 		logger.Debug(fmt.Sprintf("***Credentials Manager: currently running goroutines: %d***", runtime.NumGoroutine()))
 
 		// <-time.After(30 * time.Second)
-		if err := refreshTokenHandler(); err != nil {
+		refresh := refreshTokenHandler
+		if oauthConfig.GrantType == GrantTypeClientCredentials {
+			// Client credentials tokens have no refresh token; re-request from scratch instead.
+			refresh = clientCredentialsFlow
+		}
+		if err := refresh(); err != nil {
 			// If token refresh results in error, stop the refresh manager
 			refreshTokenManagerRunning = false
 			return
@@ -174,6 +345,20 @@ func (credentials *CredentialStorage) persistCredentials(path string) {
 		return
 	}
 
+	output := buf.Bytes()
+
+	if len(credentialsConfig.EncryptionKey) > 0 {
+		encrypted, err := encryptCredentials(output)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Error encrypting credentials: %s\n", err.Error()))
+			return
+		}
+		output = encrypted
+	} else if !credentialsConfig.AllowPlaintextStorage {
+		logger.Error("Refusing to persist plaintext credentials: set EncryptionKey or AllowPlaintextStorage=true")
+		return
+	}
+
 	// create the file
 	f, err := os.Create(filepath.Join(path, "credentials.toml"))
 	if err != nil {
@@ -181,7 +366,7 @@ func (credentials *CredentialStorage) persistCredentials(path string) {
 		return
 	}
 	// write a string
-	_, err = f.WriteString(buf.String())
+	_, err = f.Write(output)
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("Error writing file to save credentials: %s\n", err.Error()))
 	}
@@ -194,12 +379,227 @@ func (credentials *CredentialStorage) persistCredentials(path string) {
 }
 
 func openLoginPage() {
-	if credentialsConfig.Browser {
-		browserOpenErr := exec.Command("open", fmt.Sprintf("%s/home", oauthConfig.BaseURL())).Start()
-		if browserOpenErr != nil {
-			logger.Error(fmt.Sprintf("Error opening browser to login: %s\n", browserOpenErr.Error()))
+	loginURL := fmt.Sprintf("%s/home", oauthConfig.BaseURL())
+
+	if !credentialsConfig.Browser {
+		logger.Info(fmt.Sprintf("Open the following URL to login: %s", loginURL))
+		return
+	}
+
+	if err := openBrowser(loginURL); err != nil {
+		logger.Error(fmt.Sprintf("Error opening browser to login: %s", err.Error()))
+		logger.Info(fmt.Sprintf("Open the following URL to login: %s", loginURL))
+	}
+}
+
+// openBrowser launches the system's default browser at url, picking the
+// right command for the current OS.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	return cmd.Start()
+}
+
+func storeGraphAuthentication(graphAuth *GraphAuthentication) {
+	graphCredentialStorage.lock.Lock()
+	defer graphCredentialStorage.lock.Unlock()
+
+	graphCredentialStorage.credentials.Token = graphAuth.Token
+	graphCredentialStorage.credentials.AccessToken = graphAuth.AccessToken
+	graphCredentialStorage.credentials.ExpiresIn = graphAuth.ExpiresIn
+	graphCredentialStorage.expiresTimestamp = time.Now().Add(time.Second * time.Duration(graphAuth.ExpiresIn))
+	graphCredentialStorage.credentials.RefreshToken = graphAuth.RefreshToken
+	graphCredentialStorage.credentials.Scope = graphAuth.Scope
+	graphCredentialStorage.authenticated = true
+}
+
+func writeDeviceCodePrompt(deviceCode *deviceCodeResponse) {
+	if len(credentialsConfig.DeviceCodeFilePath) == 0 {
+		return
+	}
+
+	content := fmt.Sprintf("%s\n%s\n", deviceCode.UserCode, deviceCode.VerificationURI)
+	if err := os.WriteFile(credentialsConfig.DeviceCodeFilePath, []byte(content), 0644); err != nil {
+		logger.Error(fmt.Sprintf("Error writing device code prompt file: %s", err.Error()))
+	}
+}
+
+func requestDeviceCode() (*deviceCodeResponse, error) {
+	data := url.Values{
+		"client_id": {oauthConfig.ClientID},
+		"scope":     {"https://graph.microsoft.com/.default offline_access"},
+	}
+
+	resp, err := http.PostForm(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/devicecode", oauthConfig.TenantID), data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var tokenErr tokenErrorResponse
+		if jsonErr := json.Unmarshal(body, &tokenErr); jsonErr == nil && len(tokenErr.Error) > 0 {
+			return nil, fmt.Errorf("device code request failed with status %d: %s: %s", resp.StatusCode, tokenErr.Error, tokenErr.ErrorDescription)
 		}
+		return nil, fmt.Errorf("device code request failed with status %d", resp.StatusCode)
 	}
+
+	var deviceCode deviceCodeResponse
+	if err := json.Unmarshal(body, &deviceCode); err != nil {
+		return nil, err
+	}
+
+	return &deviceCode, nil
+}
+
+func pollDeviceCodeToken(deviceCode string) (*GraphAuthentication, error) {
+	data := url.Values{
+		"client_id":   {oauthConfig.ClientID},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+	}
+
+	resp, err := http.PostForm(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", oauthConfig.TenantID), data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var tokenErr tokenErrorResponse
+		if jsonErr := json.Unmarshal(body, &tokenErr); jsonErr == nil {
+			switch tokenErr.Error {
+			case "authorization_pending":
+				return nil, errAuthorizationPending
+			case "slow_down":
+				return nil, errSlowDown
+			}
+		}
+		return nil, fmt.Errorf("device code token request failed with status %d", resp.StatusCode)
+	}
+
+	var graphAuth GraphAuthentication
+	if err := json.Unmarshal(body, &graphAuth); err != nil {
+		return nil, err
+	}
+
+	return &graphAuth, nil
+}
+
+// deviceCodeFlow runs the OAuth device code flow for headless machines: it
+// requests a user code, logs (and optionally writes to a file) the
+// verification URL, then polls the token endpoint until the user has signed
+// in, the code expires, or a fatal error is returned.
+func deviceCodeFlow() error {
+	deviceCode, err := requestDeviceCode()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error requesting device code: %s", err.Error()))
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("To sign in, use a web browser to open %s and enter the code %s", deviceCode.VerificationURI, deviceCode.UserCode))
+	writeDeviceCodePrompt(deviceCode)
+
+	interval := time.Duration(deviceCode.Interval) * time.Second
+	if interval == 0 {
+		interval = defaultDeviceCodePollInterval
+	}
+	deadline := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		graphAuth, pollErr := pollDeviceCodeToken(deviceCode.DeviceCode)
+		if pollErr == errAuthorizationPending {
+			continue
+		}
+		if pollErr == errSlowDown {
+			interval += defaultDeviceCodePollInterval
+			continue
+		}
+		if pollErr != nil {
+			logger.Error(fmt.Sprintf("Error polling for device code token: %s", pollErr.Error()))
+			return pollErr
+		}
+
+		storeGraphAuthentication(graphAuth)
+		logger.Info("Device code sign-in succeeded")
+		return nil
+	}
+
+	return fmt.Errorf("device code expired before sign-in completed")
+}
+
+// clientCredentialsFlow authenticates as the application itself, with no
+// signed-in user and no refresh token. It is also used to re-authenticate
+// once the access token is about to expire.
+func clientCredentialsFlow() error {
+	data := url.Values{
+		"client_id":     {oauthConfig.ClientID},
+		"client_secret": {oauthConfig.ClientSecret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+		"grant_type":    {"client_credentials"},
+	}
+
+	resp, err := http.PostForm(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", oauthConfig.TenantID), data)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error acquiring client credentials token: %s", err.Error()))
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error reading client credentials token response: %s", err.Error()))
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var tokenErr tokenErrorResponse
+		if jsonErr := json.Unmarshal(body, &tokenErr); jsonErr == nil && len(tokenErr.Error) > 0 {
+			err := fmt.Errorf("client credentials request failed with status %d: %s: %s", resp.StatusCode, tokenErr.Error, tokenErr.ErrorDescription)
+			logger.Error(err.Error())
+			return err
+		}
+		err := fmt.Errorf("client credentials request failed with status %d", resp.StatusCode)
+		logger.Error(err.Error())
+		return err
+	}
+
+	var graphAuth GraphAuthentication
+	if err := json.Unmarshal(body, &graphAuth); err != nil {
+		logger.Error(fmt.Sprintf("Error decoding client credentials token response: %s", err.Error()))
+		return err
+	}
+
+	if len(graphAuth.AccessToken) == 0 {
+		err := fmt.Errorf("client credentials request returned no access token")
+		logger.Error(err.Error())
+		return err
+	}
+
+	storeGraphAuthentication(&graphAuth)
+	logger.Info("Client credentials sign-in succeeded")
+	return nil
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -215,10 +615,81 @@ func errorHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "<p>Error on login to Microsoft Graph API.</p><br/><p>Try again at <a href='/home'>Home</a></p>")
 }
 
+// generateCodeVerifier returns a PKCE (RFC 7636) code verifier: the base64url
+// encoding (no padding) of 32 random bytes, well within the 43-128 char range.
+func generateCodeVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func codeChallengeFromVerifier(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func generateState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// storePKCEVerifier remembers verifier under state so callbackHandler can
+// retrieve it once the user is redirected back, and opportunistically prunes
+// anything older than pkceVerifierTTL.
+func storePKCEVerifier(state, verifier string) {
+	pkceStore.Lock()
+	defer pkceStore.Unlock()
+
+	for s, entry := range pkceStore.entries {
+		if time.Since(entry.created) > pkceVerifierTTL {
+			delete(pkceStore.entries, s)
+		}
+	}
+
+	pkceStore.entries[state] = pkceEntry{verifier: verifier, created: time.Now()}
+}
+
+// takePKCEVerifier looks up and removes the verifier for state. It returns
+// false if state is unknown or the entry has expired.
+func takePKCEVerifier(state string) (string, bool) {
+	pkceStore.Lock()
+	defer pkceStore.Unlock()
+
+	entry, ok := pkceStore.entries[state]
+	delete(pkceStore.entries, state)
+	if !ok || time.Since(entry.created) > pkceVerifierTTL {
+		return "", false
+	}
+
+	return entry.verifier, true
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	verifier, err := generateCodeVerifier()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error generating PKCE code verifier: %s", err.Error()))
+		http.Redirect(w, r, "/error", http.StatusInternalServerError)
+		return
+	}
+
+	state, err := generateState()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error generating OAuth state: %s", err.Error()))
+		http.Redirect(w, r, "/error", http.StatusInternalServerError)
+		return
+	}
+
+	storePKCEVerifier(state, verifier)
+
 	// Redirect the user to the Microsoft login page
-	url := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=Calendars.Read", oauthConfig.TenantID, oauthConfig.ClientID, oauthConfig.RedirectURI())
-	http.Redirect(w, r, url, http.StatusFound)
+	loginURL := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=Calendars.Read&state=%s&code_challenge=%s&code_challenge_method=S256",
+		oauthConfig.TenantID, oauthConfig.ClientID, oauthConfig.RedirectURI(), state, codeChallengeFromVerifier(verifier))
+	http.Redirect(w, r, loginURL, http.StatusFound)
 }
 
 func refreshTokenHandler() error {
@@ -277,6 +748,14 @@ func refreshTokenHandler() error {
 func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the authorization code from the query parameter
 	code := r.URL.Query().Get("code")
+	state := r.URL.Query().Get("state")
+
+	verifier, ok := takePKCEVerifier(state)
+	if !ok {
+		logger.Error("Error on callback: missing or expired OAuth state")
+		http.Redirect(w, r, "/error", http.StatusBadRequest)
+		return
+	}
 
 	// Use the authorization code to acquire an access token
 	data := url.Values{
@@ -285,7 +764,11 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		"code":          {code},
 		"redirect_uri":  {oauthConfig.RedirectURI()},
 		"grant_type":    {"authorization_code"},
-		"client_secret": {oauthConfig.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	// ClientSecret is optional: public-client registrations rely on PKCE instead.
+	if len(oauthConfig.ClientSecret) > 0 {
+		data.Set("client_secret", oauthConfig.ClientSecret)
 	}
 
 	resp, err := http.PostForm(fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", oauthConfig.TenantID), data)
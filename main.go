@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -8,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +21,8 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/easilok/outlook_event_reading/authentication"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type GraphAuthentication struct {
@@ -56,6 +63,49 @@ type OutlookEventList struct {
 type ApplicationConfig struct {
 	OauthConfig       authentication.OauthConfig
 	CredentialsConfig authentication.CredentialsConfig
+	LoggingConfig     LoggingConfig
+}
+
+// LoggingConfig controls where logs go and how they're rotated, so
+// long-running deployments don't grow an unbounded log file. LogFile left
+// empty keeps the default of logging to stderr.
+type LoggingConfig struct {
+	LogFile       string
+	LogMaxSizeMB  int
+	LogMaxBackups int
+	LogMaxAgeDays int
+	LogCompress   bool
+	LogLocalTime  bool
+	// LogFormat is "text" (default) or "json".
+	LogFormat string
+}
+
+// GraphSubscription mirrors a Microsoft Graph change notification
+// subscription resource, used both to create/renew one and to remember the
+// clientState a notification must present.
+type GraphSubscription struct {
+	Id                 string `json:"id,omitempty"`
+	Resource           string `json:"resource"`
+	ChangeType         string `json:"changeType"`
+	NotificationUrl    string `json:"notificationUrl"`
+	ClientState        string `json:"clientState"`
+	ExpirationDateTime string `json:"expirationDateTime"`
+}
+
+type GraphSubscriptionStorage struct {
+	Lock         sync.Mutex
+	subscription GraphSubscription
+}
+
+type graphNotification struct {
+	SubscriptionId string `json:"subscriptionId"`
+	ClientState    string `json:"clientState"`
+	Resource       string `json:"resource"`
+	ChangeType     string `json:"changeType"`
+}
+
+type graphNotificationPayload struct {
+	Value []graphNotification `json:"value"`
 }
 
 const (
@@ -64,6 +114,16 @@ const (
 	defaultPort     = 8000
 )
 
+// subscriptionLifetime is Graph's maximum allowed expiration for a
+// me/events subscription (~4230 minutes).
+const subscriptionLifetime = 4230 * time.Minute
+
+// subscriptionRenewBuffer is how long before expiry the subscription is renewed.
+const subscriptionRenewBuffer = 10 * time.Minute
+
+// pollingInterval is used as a fallback when change notifications aren't available.
+const pollingInterval = 60 * time.Second
+
 var clientID = ""
 var clientSecret = ""
 var tenantID = ""
@@ -75,6 +135,7 @@ var redirectURI = fmt.Sprintf("%s://%s:%d/callback", serverProtocol, serverHost,
 var graphEvents OutlookEventList
 var applicationConfig ApplicationConfig
 var graphCredentials *authentication.CredentialStorage
+var graphSubscription GraphSubscriptionStorage
 
 var log *logrus.Logger
 
@@ -107,12 +168,7 @@ func loadConfig() {
 func main() {
 	loadConfig()
 	fmt.Printf("%+v\n", applicationConfig)
-	log = logrus.New()
-	log.SetLevel(logrus.DebugLevel)
-	log.SetFormatter(&logrus.TextFormatter{
-		// DisableColors: true,
-		FullTimestamp: true,
-	})
+	log = newLogger(applicationConfig.LoggingConfig)
 	// If you wish to add the calling method as a field, instruct the logger via:
 	// log.SetReportCaller(true)
 
@@ -125,10 +181,66 @@ func main() {
 	}
 
 	http.HandleFunc("/next-event", nextEventHandler)
+	http.HandleFunc("/events.ics", eventsICSHandler)
+	http.HandleFunc("/events.json", eventsJSONHandler)
+	http.HandleFunc("/graph-notifications", graphNotificationsHandler)
 
 	graphCredentials = authentication.Run(&applicationConfig.OauthConfig, &applicationConfig.CredentialsConfig, log)
-	go outlookEventRefreshManager()
-	log.Fatal(http.Serve(l, nil))
+	go outlookEventManager()
+	log.Fatal(serveCallbackListener(l, &applicationConfig.OauthConfig))
+}
+
+// newLogger builds the application logger from config, routing it through
+// lumberjack for rotation whenever LogFile is set so long-running deployments
+// don't grow an unbounded log file.
+func newLogger(config LoggingConfig) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+
+	if config.LogFormat == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
+
+	if len(config.LogFile) > 0 {
+		logger.SetOutput(&lumberjack.Logger{
+			Filename:   config.LogFile,
+			MaxSize:    config.LogMaxSizeMB,
+			MaxBackups: config.LogMaxBackups,
+			MaxAge:     config.LogMaxAgeDays,
+			Compress:   config.LogCompress,
+			LocalTime:  config.LogLocalTime,
+		})
+	}
+
+	return logger
+}
+
+// serveCallbackListener serves http.DefaultServeMux over l, using HTTPS when
+// oauth requests it: ACMECacheDir for an automatically managed Let's
+// Encrypt certificate, or TLSCert/TLSKey for a static one. Azure AD requires
+// https for any non-localhost redirect URI.
+func serveCallbackListener(l net.Listener, oauth *authentication.OauthConfig) error {
+	if len(oauth.ACMECacheDir) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(oauth.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(oauth.ServerHost),
+		}
+		server := &http.Server{
+			TLSConfig: manager.TLSConfig(),
+		}
+		return server.ServeTLS(l, "", "")
+	}
+
+	if len(oauth.TLSCert) > 0 && len(oauth.TLSKey) > 0 {
+		return http.ServeTLS(l, nil, oauth.TLSCert, oauth.TLSKey)
+	}
+
+	return http.Serve(l, nil)
 }
 
 func nextEventHandler(w http.ResponseWriter, r *http.Request) {
@@ -146,17 +258,367 @@ func nextEventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func outlookEventRefreshManager() {
+// icsLineFoldLimit is the maximum octets per line before RFC 5545 folding applies.
+const icsLineFoldLimit = 75
+
+func foldICSLine(line string) string {
+	if len(line) <= icsLineFoldLimit {
+		return line
+	}
+
+	var folded strings.Builder
+	limit := icsLineFoldLimit
+	for len(line) > limit {
+		folded.WriteString(line[:limit])
+		folded.WriteString("\r\n ")
+		line = line[limit:]
+		// Continuation lines start with a space, which counts toward the limit.
+		limit = icsLineFoldLimit - 1
+	}
+	folded.WriteString(line)
+	return folded.String()
+}
+
+var icsTextReplacer = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\;",
+	",", "\\,",
+	"\n", "\\n",
+)
+
+func escapeICSText(value string) string {
+	return icsTextReplacer.Replace(value)
+}
+
+// formatICSDateTime converts a Graph dateTime/timeZone pair to the UTC,
+// "Z"-suffixed form RFC 5545 expects.
+func formatICSDateTime(dt GraphApiDateTime) (string, error) {
+	parsed, err := time.Parse("2006-01-02T15:04:05.9999999", dt.DateTime)
+	if err != nil {
+		return "", err
+	}
+
+	if loc, locErr := time.LoadLocation(dt.Timezone); locErr == nil {
+		parsed = time.Date(parsed.Year(), parsed.Month(), parsed.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), parsed.Nanosecond(), loc)
+	}
+
+	return parsed.UTC().Format("20060102T150405Z"), nil
+}
+
+// buildICSCalendar renders events as a VCALENDAR with one VEVENT per item.
+func buildICSCalendar(events []OutlookEvent, lastUpdate time.Time) (string, error) {
+	var calendar strings.Builder
+	writeLine := func(line string) {
+		calendar.WriteString(foldICSLine(line))
+		calendar.WriteString("\r\n")
+	}
+
+	dtstamp := lastUpdate.UTC().Format("20060102T150405Z")
+
+	writeLine("BEGIN:VCALENDAR")
+	writeLine("VERSION:2.0")
+	writeLine("PRODID:-//outlook-events-portal//EN")
+
+	for _, event := range events {
+		start, err := formatICSDateTime(event.Start)
+		if err != nil {
+			return "", err
+		}
+		end, err := formatICSDateTime(event.End)
+		if err != nil {
+			return "", err
+		}
+
+		writeLine("BEGIN:VEVENT")
+		writeLine(fmt.Sprintf("UID:%s", escapeICSText(event.Id)))
+		writeLine(fmt.Sprintf("DTSTAMP:%s", dtstamp))
+		writeLine(fmt.Sprintf("DTSTART:%s", start))
+		writeLine(fmt.Sprintf("DTEND:%s", end))
+		writeLine(fmt.Sprintf("SUMMARY:%s", escapeICSText(event.Subject)))
+		if len(event.Location.Name) > 0 {
+			writeLine(fmt.Sprintf("LOCATION:%s", escapeICSText(event.Location.Name)))
+		}
+		writeLine("END:VEVENT")
+	}
+
+	writeLine("END:VCALENDAR")
+
+	return calendar.String(), nil
+}
+
+func etagForBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("\"%x\"", sum)
+}
+
+func snapshotEvents() ([]OutlookEvent, time.Time) {
+	graphEvents.Lock.Lock()
+	defer graphEvents.Lock.Unlock()
+
+	value := make([]OutlookEvent, len(graphEvents.Value))
+	copy(value, graphEvents.Value)
+	return value, graphEvents.LastUpdate
+}
+
+// eventsICSHandler serves the fetched events as an RFC 5545 calendar, so
+// any ICS-aware client can subscribe to them directly.
+func eventsICSHandler(w http.ResponseWriter, r *http.Request) {
+	value, lastUpdate := snapshotEvents()
+
+	body, err := buildICSCalendar(value, lastUpdate)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error building ICS calendar: %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := etagForBody([]byte(body))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, body)
+}
+
+// eventsJSONHandler serves the fetched events as parsed JSON.
+func eventsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	value, _ := snapshotEvents()
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error encoding events as JSON: %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := etagForBody(body)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("ETag", etag)
+	w.Write(body)
+}
+
+// outlookEventManager fetches the calendar once at startup, then tries to
+// subscribe to Graph change notifications so further fetches are
+// event-driven rather than polled. If the subscription can't be created yet
+// (e.g. the interactive login hasn't completed, or the callback host isn't
+// publicly reachable), it falls back to the old 60s polling loop, which
+// keeps retrying subscription creation on every tick until it succeeds.
+func outlookEventManager() {
+	fetchEventsFromOutlook()
+
+	if createGraphSubscription() {
+		go graphSubscriptionRenewalManager()
+		return
+	}
+
+	log.Warn("Falling back to polling for calendar changes until a subscription can be created")
+	outlookEventPollingManager()
+}
+
+func outlookEventPollingManager() {
 	// This manager is a infinite loop only stopping if token refresh results in error
 	for {
-		fetchEventsTicker := 60 * time.Second
-
-		time.Sleep(fetchEventsTicker)
+		time.Sleep(pollingInterval)
 
 		log.Debug(fmt.Sprintf("***Events Manager: currently running goroutines: %d***", runtime.NumGoroutine()))
 
 		fetchEventsFromOutlook()
+
+		// Retry subscription creation on every tick: the interactive login
+		// flow authenticates asynchronously after this manager starts, so the
+		// first attempt in outlookEventManager commonly fails before login
+		// completes.
+		if createGraphSubscription() {
+			log.Info("Subscribed to Outlook change notifications, stopping polling")
+			go graphSubscriptionRenewalManager()
+			return
+		}
+	}
+}
+
+func generateSubscriptionClientState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// sendGraphSubscriptionRequest sends a create (POST) or renew (PATCH)
+// request for a Graph subscription and decodes the resulting resource.
+func sendGraphSubscriptionRequest(method string, endpoint string, body GraphSubscription, accessToken string) (*GraphSubscription, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	var result GraphSubscription
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// createGraphSubscription subscribes to change notifications for the user's
+// events. It returns false (without treating it as fatal) if the
+// subscription can't be created, so the caller can fall back to polling.
+func createGraphSubscription() bool {
+	graphAccessToken, isAuthenticated := graphCredentials.GetAccessToken()
+	if !isAuthenticated {
+		log.Warn("Application is not yet authenticated, skipping change notification subscription")
+		return false
+	}
+
+	clientState, err := generateSubscriptionClientState()
+	if err != nil {
+		log.Error(fmt.Sprintf("Error generating subscription client state: %s", err.Error()))
+		return false
+	}
+
+	subscription := GraphSubscription{
+		Resource:           "me/events",
+		ChangeType:         "created,updated,deleted",
+		NotificationUrl:    fmt.Sprintf("%s/graph-notifications", applicationConfig.OauthConfig.BaseURL()),
+		ClientState:        clientState,
+		ExpirationDateTime: time.Now().UTC().Add(subscriptionLifetime).Format(time.RFC3339),
 	}
+
+	created, err := sendGraphSubscriptionRequest("POST", "https://graph.microsoft.com/v1.0/subscriptions", subscription, graphAccessToken)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Subscription creation failed: %s", err.Error()))
+		return false
+	}
+
+	graphSubscription.Lock.Lock()
+	graphSubscription.subscription = *created
+	graphSubscription.subscription.ClientState = clientState
+	graphSubscription.Lock.Unlock()
+
+	log.Info(fmt.Sprintf("Subscribed to Outlook change notifications, expiring at %s", created.ExpirationDateTime))
+	return true
+}
+
+// graphSubscriptionRenewalManager renews the subscription shortly before it
+// expires, for as long as renewal keeps succeeding.
+func graphSubscriptionRenewalManager() {
+	for {
+		graphSubscription.Lock.Lock()
+		expiration, err := time.Parse(time.RFC3339, graphSubscription.subscription.ExpirationDateTime)
+		subscriptionId := graphSubscription.subscription.Id
+		graphSubscription.Lock.Unlock()
+
+		if err != nil {
+			log.Error(fmt.Sprintf("Error parsing subscription expiration: %s", err.Error()))
+			return
+		}
+
+		sleepDuration := time.Until(expiration) - subscriptionRenewBuffer
+		if sleepDuration > 0 {
+			time.Sleep(sleepDuration)
+		}
+
+		if !renewGraphSubscription(subscriptionId) {
+			log.Warn("Falling back to polling for calendar changes after failed subscription renewal")
+			go outlookEventPollingManager()
+			return
+		}
+	}
+}
+
+func renewGraphSubscription(subscriptionId string) bool {
+	graphAccessToken, isAuthenticated := graphCredentials.GetAccessToken()
+	if !isAuthenticated {
+		log.Warn("Application is not yet authenticated, cannot renew subscription")
+		return false
+	}
+
+	renewal := GraphSubscription{
+		ExpirationDateTime: time.Now().UTC().Add(subscriptionLifetime).Format(time.RFC3339),
+	}
+
+	endpoint := fmt.Sprintf("https://graph.microsoft.com/v1.0/subscriptions/%s", subscriptionId)
+	renewed, err := sendGraphSubscriptionRequest("PATCH", endpoint, renewal, graphAccessToken)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error renewing subscription: %s", err.Error()))
+		return false
+	}
+
+	graphSubscription.Lock.Lock()
+	graphSubscription.subscription.ExpirationDateTime = renewed.ExpirationDateTime
+	graphSubscription.Lock.Unlock()
+
+	log.Info(fmt.Sprintf("Renewed Outlook change notification subscription, expiring at %s", renewed.ExpirationDateTime))
+	return true
+}
+
+// graphNotificationsHandler receives Graph change notifications for the
+// subscription created above. During subscription creation, Graph first
+// validates the endpoint by POSTing a validationToken that must be echoed
+// back as plain text within 10 seconds.
+func graphNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if validationToken := r.URL.Query().Get("validationToken"); len(validationToken) > 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, validationToken)
+		return
+	}
+
+	var payload graphNotificationPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		log.Error(fmt.Sprintf("Error decoding graph notification: %s", err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	graphSubscription.Lock.Lock()
+	expectedClientState := graphSubscription.subscription.ClientState
+	graphSubscription.Lock.Unlock()
+
+	// Graph commonly batches several notifications into one payload when a
+	// few events change at once; refetch at most once per payload rather
+	// than once per notification entry.
+	refetch := false
+	for _, notification := range payload.Value {
+		if notification.ClientState != expectedClientState {
+			log.Warn("Received graph notification with unexpected clientState, ignoring")
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Received change notification for %s (%s)", notification.Resource, notification.ChangeType))
+		refetch = true
+	}
+
+	if refetch {
+		go fetchEventsFromOutlook()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func fetchEventsFromOutlook() {
@@ -193,9 +655,11 @@ func fetchEventsFromOutlook() {
 	}
 
 	// var graphEvents map[string]interface{}
+	graphEvents.Lock.Lock()
 	err = json.NewDecoder(eventsResponse.Body).Decode(&graphEvents)
 	eventsResponse.Body.Close()
 	if err != nil {
+		graphEvents.Lock.Unlock()
 		log.Error(fmt.Sprintf("Error decoding outlook events: %s", err))
 		return
 	}
@@ -212,6 +676,7 @@ func fetchEventsFromOutlook() {
 	for i, event := range graphEvents.Value {
 		log.Info(fmt.Sprintf("Event %d; Subject: %s; Start time: %s; End time: %s;", i+1, event.Subject, event.Start.DateTime, event.End.DateTime))
 	}
+	graphEvents.Lock.Unlock()
 
 	graphEvents.persistEvent("/tmp")
 